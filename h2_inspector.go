@@ -0,0 +1,441 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/telnet2/go-tcp-proxy/metrics"
+)
+
+// Direction identifies which leg of the proxied connection a frame or byte
+// chunk travelled on.
+type Direction int
+
+const (
+	ClientToServer Direction = iota
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return ">>"
+	}
+	return "<<"
+}
+
+// h2StreamState is a coarse view of RFC 7540 stream lifecycle, tracked from
+// whichever frames we happen to observe passing through in either direction.
+type h2StreamState int
+
+const (
+	h2StreamIdle h2StreamState = iota
+	h2StreamOpen
+	h2StreamHalfClosed
+	h2StreamClosed
+)
+
+func (s h2StreamState) String() string {
+	switch s {
+	case h2StreamOpen:
+		return "open"
+	case h2StreamHalfClosed:
+		return "half-closed"
+	case h2StreamClosed:
+		return "closed"
+	default:
+		return "idle"
+	}
+}
+
+type h2Stream struct {
+	id         uint32
+	state      h2StreamState
+	opened     time.Time
+	halfClosed [2]bool // which direction(s) have sent END_STREAM
+}
+
+// headerAssembly accumulates a HEADERS or PUSH_PROMISE block fragment across
+// any CONTINUATION frames that follow it, per direction, so the dynamic
+// table is only asked to decode once the block is complete.
+type headerAssembly struct {
+	streamID      uint32
+	promisedID    uint32
+	isPushPromise bool
+	endStream     bool
+	block         []byte
+}
+
+// H2Frame is the mutable view of a decoded HTTP/2 frame handed to
+// Interceptor.OnH2Frame. Only the fields relevant to the frame's Type are
+// populated; an interceptor may rewrite Headers or Data in place and the
+// inspector will re-encode and re-emit the frame with the change applied.
+type H2Frame struct {
+	Type       string // "HEADERS", "PUSH_PROMISE" or "DATA"; other frame types are not handed to interceptors
+	StreamID   uint32
+	PromisedID uint32
+	EndStream  bool
+	Headers    []hpack.HeaderField
+	Data       []byte
+}
+
+// H2Inspector decodes an HTTP/2 connection tunneled through the proxy. One
+// instance is shared by both pipe goroutines of a single Proxy so that the
+// HPACK dynamic table and stream table stay consistent for the life of the
+// connection: each direction gets its own long-lived hpack.Decoder,
+// hpack.Encoder and http2.Framer pair, created once and driven to
+// completion rather than rebuilt per frame.
+type H2Inspector struct {
+	log     Logger
+	chain   *InterceptorChain
+	metrics *metrics.Sink
+
+	mu      sync.Mutex
+	streams map[uint32]*h2Stream
+
+	decoders [2]*hpack.Decoder
+	encoders [2]*hpack.Encoder
+	encBufs  [2]*bytes.Buffer
+	pending  [2]*headerAssembly
+}
+
+// NewH2Inspector creates an inspector that logs structured frame and stream
+// lifecycle records to log and reports frame/stream metrics to sink (which
+// may be nil), running frames through chain (which may be nil) before
+// re-emitting them to the peer.
+func NewH2Inspector(log Logger, chain *InterceptorChain, sink *metrics.Sink) *H2Inspector {
+	if log == nil {
+		log = NullLogger{}
+	}
+	if sink == nil {
+		sink = metrics.New(nil)
+	}
+	h := &H2Inspector{
+		log:     log,
+		chain:   chain,
+		metrics: sink,
+		streams: make(map[uint32]*h2Stream),
+	}
+	for _, d := range []Direction{ClientToServer, ServerToClient} {
+		h.decoders[d] = hpack.NewDecoder(2048, nil)
+		h.encBufs[d] = &bytes.Buffer{}
+		h.encoders[d] = hpack.NewEncoder(h.encBufs[d])
+	}
+	return h
+}
+
+// CheckPreface consumes and validates the client connection preface. It
+// must only be called for the client->server direction, once, before the
+// framer starts reading frames.
+func (h *H2Inspector) CheckPreface(r io.Reader) error {
+	buf := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return fmt.Errorf("read preface: %w", err)
+	}
+	if string(buf) != http2.ClientPreface {
+		return fmt.Errorf("not an HTTP/2 preface: %q", buf)
+	}
+	return nil
+}
+
+// Run reads frames from r (one direction of the tunneled connection) and
+// re-emits each one to w via a second http2.Framer, constructed once for
+// this direction and reused for the lifetime of the connection. Frames pass
+// through the interceptor chain before being re-emitted, so a chain member
+// can rewrite HPACK-decoded headers or frame payloads in place.
+func (h *H2Inspector) Run(dir Direction, r io.Reader, w io.Writer) error {
+	rfr := http2.NewFramer(nil, r)
+	wfr := http2.NewFramer(w, nil)
+
+	for {
+		f, err := rfr.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if err := h.handleFrame(dir, f, wfr); err != nil {
+			return err
+		}
+	}
+}
+
+func (h *H2Inspector) handleFrame(dir Direction, f http2.Frame, wfr *http2.Framer) error {
+	h.metrics.H2FramesTotal.WithLabelValues(frameTypeName(f)).Inc()
+
+	switch fr := f.(type) {
+	case *http2.SettingsFrame:
+		h.log.Info("%s SETTINGS ack=%v %s", dir, fr.IsAck(), fr.String())
+		if fr.IsAck() {
+			return wfr.WriteSettingsAck()
+		}
+		var settings []http2.Setting
+		fr.ForeachSetting(func(s http2.Setting) error {
+			settings = append(settings, s)
+			return nil
+		})
+		return wfr.WriteSettings(settings...)
+
+	case *http2.HeadersFrame:
+		h.setStreamState(fr.StreamID, h2StreamOpen)
+		h.beginHeaderBlock(dir, fr.StreamID, 0, false, fr.StreamEnded(), fr.HeaderBlockFragment())
+		if fr.HeadersEnded() {
+			if err := h.finishHeaderBlock(dir, wfr); err != nil {
+				return err
+			}
+		}
+		if fr.StreamEnded() {
+			h.markEndStream(dir, fr.StreamID)
+		}
+		return nil
+
+	case *http2.PushPromiseFrame:
+		h.setStreamState(fr.PromiseID, h2StreamIdle)
+		h.beginHeaderBlock(dir, fr.StreamID, fr.PromiseID, true, false, fr.HeaderBlockFragment())
+		if fr.HeadersEnded() {
+			return h.finishHeaderBlock(dir, wfr)
+		}
+		return nil
+
+	case *http2.ContinuationFrame:
+		h.appendHeaderBlock(dir, fr.HeaderBlockFragment())
+		if fr.HeadersEnded() {
+			return h.finishHeaderBlock(dir, wfr)
+		}
+		return nil
+
+	case *http2.DataFrame:
+		h.log.Info("%s DATA stream=%d len=%d end_stream=%v", dir, fr.StreamID, len(fr.Data()), fr.StreamEnded())
+		if fr.StreamEnded() {
+			h.markEndStream(dir, fr.StreamID)
+		}
+		evt := &H2Frame{Type: "DATA", StreamID: fr.StreamID, EndStream: fr.StreamEnded(), Data: append([]byte(nil), fr.Data()...)}
+		h.intercept(dir, evt)
+		return wfr.WriteData(evt.StreamID, evt.EndStream, evt.Data)
+
+	case *http2.RSTStreamFrame:
+		h.log.Info("%s RST_STREAM stream=%d error=%s", dir, fr.StreamID, fr.ErrCode)
+		h.closeStream(fr.StreamID)
+		return wfr.WriteRSTStream(fr.StreamID, fr.ErrCode)
+
+	case *http2.GoAwayFrame:
+		h.log.Info("%s GOAWAY last_stream=%d error=%s debug=%q", dir, fr.LastStreamID, fr.ErrCode, fr.DebugData())
+		return wfr.WriteGoAway(fr.LastStreamID, fr.ErrCode, fr.DebugData())
+
+	case *http2.PingFrame:
+		h.log.Info("%s PING ack=%v", dir, fr.IsAck())
+		return wfr.WritePing(fr.IsAck(), fr.Data)
+
+	case *http2.WindowUpdateFrame:
+		h.log.Info("%s WINDOW_UPDATE stream=%d increment=%d", dir, fr.StreamID, fr.Increment)
+		return wfr.WriteWindowUpdate(fr.StreamID, fr.Increment)
+
+	case *http2.PriorityFrame:
+		h.log.Info("%s PRIORITY stream=%d %+v", dir, fr.StreamID, fr.PriorityParam)
+		return wfr.WritePriority(fr.StreamID, fr.PriorityParam)
+
+	default:
+		hdr := f.Header()
+		h.log.Debug("%s unhandled frame type=%d len=%d, forwarding raw", dir, hdr.Type, hdr.Length)
+		return wfr.WriteRawFrame(hdr.Type, hdr.Flags, hdr.StreamID, framePayload(f))
+	}
+}
+
+// framePayload returns the raw bytes of a frame the switch above doesn't
+// otherwise understand, for WriteRawFrame to re-emit verbatim. http2.Framer
+// surfaces these as *http2.UnknownFrame; anything else would mean a new
+// http2.Frame type was added upstream with no payload accessor to match.
+func framePayload(f http2.Frame) []byte {
+	if uf, ok := f.(*http2.UnknownFrame); ok {
+		return uf.Payload()
+	}
+	return nil
+}
+
+func (h *H2Inspector) beginHeaderBlock(dir Direction, streamID, promisedID uint32, isPushPromise, endStream bool, frag []byte) {
+	h.pending[dir] = &headerAssembly{
+		streamID:      streamID,
+		promisedID:    promisedID,
+		isPushPromise: isPushPromise,
+		endStream:     endStream,
+		block:         append([]byte(nil), frag...),
+	}
+}
+
+func (h *H2Inspector) appendHeaderBlock(dir Direction, frag []byte) {
+	a := h.pending[dir]
+	if a == nil {
+		return
+	}
+	a.block = append(a.block, frag...)
+}
+
+// finishHeaderBlock decodes the completed HEADERS/PUSH_PROMISE block, runs
+// it through the interceptor chain, re-encodes it with this direction's
+// long-lived hpack.Encoder and re-emits it as a single HEADERS or
+// PUSH_PROMISE frame with END_HEADERS set (any CONTINUATION framing the
+// peer originally used is collapsed, which is valid per RFC 7540 §4.3 since
+// only the reassembled block is semantically meaningful).
+func (h *H2Inspector) finishHeaderBlock(dir Direction, wfr *http2.Framer) error {
+	a := h.pending[dir]
+	h.pending[dir] = nil
+	if a == nil {
+		return nil
+	}
+
+	fields, err := h.decoders[dir].DecodeFull(a.block)
+	if err != nil {
+		// A dynamic-table decode error is a connection error per RFC 7541
+		// §4.3: the decoder's state is now unknown, so every subsequent
+		// HEADERS/PUSH_PROMISE on this direction would be decoded against a
+		// corrupted table. Propagate it so Run/pipe tears the connection
+		// down instead of continuing with a desynced decoder.
+		return fmt.Errorf("%s HPACK decode error on stream %d: %w", dir, a.streamID, err)
+	}
+
+	kind := "HEADERS"
+	id := a.streamID
+	if a.isPushPromise {
+		kind = "PUSH_PROMISE"
+		id = a.promisedID
+	}
+	h.log.Info("%s %s stream=%d end_stream=%v fields=%d", dir, kind, id, a.endStream, len(fields))
+	for _, f := range fields {
+		h.log.Trace("%s   %s", dir, f.String())
+	}
+
+	evt := &H2Frame{Type: kind, StreamID: a.streamID, PromisedID: a.promisedID, EndStream: a.endStream, Headers: fields}
+	h.intercept(dir, evt)
+
+	buf := h.encBufs[dir]
+	buf.Reset()
+	for _, f := range evt.Headers {
+		if err := h.encoders[dir].WriteField(f); err != nil {
+			return fmt.Errorf("hpack encode: %w", err)
+		}
+	}
+	block := append([]byte(nil), buf.Bytes()...)
+
+	if a.isPushPromise {
+		return wfr.WritePushPromise(http2.PushPromiseParam{
+			StreamID:      a.streamID,
+			PromiseID:     evt.PromisedID,
+			BlockFragment: block,
+			EndHeaders:    true,
+		})
+	}
+	return wfr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      evt.StreamID,
+		BlockFragment: block,
+		EndHeaders:    true,
+		EndStream:     evt.EndStream,
+	})
+}
+
+func (h *H2Inspector) intercept(dir Direction, evt *H2Frame) {
+	if h.chain == nil {
+		return
+	}
+	h.chain.OnH2Frame(dir, evt)
+}
+
+func (h *H2Inspector) setStreamState(id uint32, s h2StreamState) {
+	if id == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.stream(id)
+	if st.state == s {
+		return
+	}
+	prev := st.state
+	st.state = s
+	h.log.Debug("stream %d: %s -> %s", id, prev, s)
+}
+
+// markEndStream records that dir has sent END_STREAM on id. Once both
+// directions have, the stream is fully closed and its lifetime is observed.
+func (h *H2Inspector) markEndStream(dir Direction, id uint32) {
+	if id == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.stream(id)
+	st.halfClosed[dir] = true
+	if st.state != h2StreamClosed {
+		st.state = h2StreamHalfClosed
+	}
+	h.log.Debug("stream %d: %s half-closed", id, dir)
+
+	if st.halfClosed[ClientToServer] && st.halfClosed[ServerToClient] {
+		h.closeLocked(st)
+	}
+}
+
+// closeStream force-closes id (e.g. on RST_STREAM) regardless of whether
+// both directions sent END_STREAM.
+func (h *H2Inspector) closeStream(id uint32) {
+	if id == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeLocked(h.stream(id))
+}
+
+func (h *H2Inspector) closeLocked(st *h2Stream) {
+	if st.state == h2StreamClosed {
+		return
+	}
+	st.state = h2StreamClosed
+	h.log.Debug("stream %d: closed", st.id)
+	if !st.opened.IsZero() {
+		h.metrics.H2StreamDuration.Observe(time.Since(st.opened).Seconds())
+	}
+}
+
+// stream returns id's tracked state, creating and timestamping it on first
+// reference. Callers must hold h.mu.
+func (h *H2Inspector) stream(id uint32) *h2Stream {
+	st, ok := h.streams[id]
+	if !ok {
+		st = &h2Stream{id: id, opened: time.Now()}
+		h.streams[id] = st
+	}
+	return st
+}
+
+// frameTypeName returns the label used for H2FramesTotal.
+func frameTypeName(f http2.Frame) string {
+	switch f.(type) {
+	case *http2.SettingsFrame:
+		return "SETTINGS"
+	case *http2.HeadersFrame:
+		return "HEADERS"
+	case *http2.PushPromiseFrame:
+		return "PUSH_PROMISE"
+	case *http2.ContinuationFrame:
+		return "CONTINUATION"
+	case *http2.DataFrame:
+		return "DATA"
+	case *http2.RSTStreamFrame:
+		return "RST_STREAM"
+	case *http2.GoAwayFrame:
+		return "GOAWAY"
+	case *http2.PingFrame:
+		return "PING"
+	case *http2.WindowUpdateFrame:
+		return "WINDOW_UPDATE"
+	case *http2.PriorityFrame:
+		return "PRIORITY"
+	default:
+		return "UNKNOWN"
+	}
+}
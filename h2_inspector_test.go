@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// runOneFrame writes write(fr) into a pipe, runs it through h.Run, and
+// returns whatever Run wrote out plus the error Run returned (typically
+// io.EOF once the pipe closes, unless write itself triggered a real error).
+func runOneFrame(t *testing.T, h *H2Inspector, dir Direction, write func(fr *http2.Framer) error) ([]byte, error) {
+	t.Helper()
+
+	pr, pw := io.Pipe()
+	go func() {
+		fr := http2.NewFramer(pw, nil)
+		if err := write(fr); err != nil {
+			t.Errorf("writing test frame: %s", err)
+		}
+		pw.Close()
+	}()
+
+	var out bytes.Buffer
+	err := h.Run(dir, pr, &out)
+	return out.Bytes(), err
+}
+
+func readFrame(t *testing.T, b []byte) http2.Frame {
+	t.Helper()
+	f, err := http2.NewFramer(nil, bytes.NewReader(b)).ReadFrame()
+	if err != nil {
+		t.Fatalf("reading forwarded frame: %s", err)
+	}
+	return f
+}
+
+func TestH2InspectorForwardsUnknownFrameVerbatim(t *testing.T) {
+	h := NewH2Inspector(nil, nil, nil)
+
+	const unknownType = http2.FrameType(0x0F)
+	payload := []byte("extension frame payload")
+
+	out, err := runOneFrame(t, h, ClientToServer, func(fr *http2.Framer) error {
+		return fr.WriteRawFrame(unknownType, 0, 7, payload)
+	})
+	if err != io.EOF {
+		t.Fatalf("Run error = %v, want io.EOF", err)
+	}
+
+	f := readFrame(t, out)
+	uf, ok := f.(*http2.UnknownFrame)
+	if !ok {
+		t.Fatalf("forwarded frame type = %T, want *http2.UnknownFrame", f)
+	}
+	if uf.Header().Type != unknownType || uf.Header().StreamID != 7 {
+		t.Fatalf("forwarded header = %+v, want type=%v stream=7", uf.Header(), unknownType)
+	}
+	if !bytes.Equal(uf.Payload(), payload) {
+		t.Fatalf("forwarded payload = %q, want %q", uf.Payload(), payload)
+	}
+}
+
+func TestH2InspectorForwardsSettingsAck(t *testing.T) {
+	h := NewH2Inspector(nil, nil, nil)
+
+	out, err := runOneFrame(t, h, ClientToServer, func(fr *http2.Framer) error {
+		return fr.WriteSettingsAck()
+	})
+	if err != io.EOF {
+		t.Fatalf("Run error = %v, want io.EOF", err)
+	}
+
+	f := readFrame(t, out)
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok {
+		t.Fatalf("forwarded frame type = %T, want *http2.SettingsFrame", f)
+	}
+	if !sf.IsAck() {
+		t.Fatal("forwarded SETTINGS frame is not an ack; a real ack must have been turned into a fresh empty SETTINGS frame")
+	}
+}
+
+func TestH2InspectorPropagatesHPACKDecodeError(t *testing.T) {
+	h := NewH2Inspector(nil, nil, nil)
+
+	// 0x80 is an indexed header field representation with index 0, which
+	// HPACK (RFC 7541 §6.1) forbids; DecodeFull must error on it.
+	malformed := []byte{0x80}
+
+	_, err := runOneFrame(t, h, ClientToServer, func(fr *http2.Framer) error {
+		return fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: malformed,
+			EndHeaders:    true,
+		})
+	})
+	if err == nil || err == io.EOF {
+		t.Fatalf("Run error = %v, want a non-EOF HPACK decode error", err)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+// Interceptor observes, and optionally rewrites, traffic flowing through a
+// Proxy. It replaces the old single-purpose Matcher/Replacer func fields:
+// those only ever saw arbitrary TCP chunks, which can't express anything
+// stateful or frame-aware. OnClientBytes/OnServerBytes cover raw byte
+// streams (the non-H2 path); OnH2Frame covers the H2 path, where it sees
+// one decoded frame at a time instead of a byte slice.
+type Interceptor interface {
+	// OnClientBytes is called with each chunk read from the client before
+	// it is forwarded to the server. It returns the bytes to forward,
+	// which may be b unchanged, a mutated b, or a replacement slice.
+	OnClientBytes(b []byte) []byte
+
+	// OnServerBytes is the server->client equivalent of OnClientBytes.
+	OnServerBytes(b []byte) []byte
+
+	// OnH2Frame is called when the Proxy is running with H2 set, once per
+	// complete HEADERS/PUSH_PROMISE header block (after any CONTINUATION
+	// frames are joined) and once per DATA frame. Other frame types are
+	// forwarded without passing through it. It may rewrite evt in place; the
+	// inspector re-encodes and re-emits the frame with the change applied.
+	OnH2Frame(dir Direction, evt *H2Frame)
+
+	// OnClose is called once the proxied connection has finished.
+	OnClose()
+}
+
+// InterceptorChain applies a sequence of Interceptors in order, each seeing
+// the output of the one before it.
+type InterceptorChain struct {
+	interceptors []Interceptor
+}
+
+// NewInterceptorChain builds a chain that runs interceptors in order.
+func NewInterceptorChain(interceptors ...Interceptor) *InterceptorChain {
+	return &InterceptorChain{interceptors: interceptors}
+}
+
+// Add appends an interceptor to the end of the chain.
+func (c *InterceptorChain) Add(i Interceptor) {
+	c.interceptors = append(c.interceptors, i)
+}
+
+// OnClientBytes runs b through every interceptor in order.
+func (c *InterceptorChain) OnClientBytes(b []byte) []byte {
+	for _, i := range c.interceptors {
+		b = i.OnClientBytes(b)
+	}
+	return b
+}
+
+// OnServerBytes runs b through every interceptor in order.
+func (c *InterceptorChain) OnServerBytes(b []byte) []byte {
+	for _, i := range c.interceptors {
+		b = i.OnServerBytes(b)
+	}
+	return b
+}
+
+// OnH2Frame runs evt through every interceptor in order.
+func (c *InterceptorChain) OnH2Frame(dir Direction, evt *H2Frame) {
+	for _, i := range c.interceptors {
+		i.OnH2Frame(dir, evt)
+	}
+}
+
+// OnClose notifies every interceptor in order that the connection closed.
+func (c *InterceptorChain) OnClose() {
+	for _, i := range c.interceptors {
+		i.OnClose()
+	}
+}
+
+// BaseInterceptor implements Interceptor as a no-op for every method. Embed
+// it in an Interceptor that only cares about one or two of the callbacks so
+// it doesn't have to stub out the rest.
+type BaseInterceptor struct{}
+
+func (BaseInterceptor) OnClientBytes(b []byte) []byte         { return b }
+func (BaseInterceptor) OnServerBytes(b []byte) []byte         { return b }
+func (BaseInterceptor) OnH2Frame(dir Direction, evt *H2Frame) {}
+func (BaseInterceptor) OnClose()                              {}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"strings"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// H2HeaderRewriter rewrites HPACK-decoded header fields on HEADERS and
+// PUSH_PROMISE frames. Rewrite is called once per frame with the decoded
+// field list and returns the field list to actually emit; the H2Inspector
+// re-encodes whatever it returns and re-emits the frame via its framer, so
+// Rewrite is free to add, drop or edit fields.
+type H2HeaderRewriter struct {
+	BaseInterceptor
+
+	Rewrite func(dir Direction, streamID uint32, fields []hpack.HeaderField) []hpack.HeaderField
+}
+
+// NewH2HeaderRewriter returns an interceptor that applies rewrite to every
+// HEADERS/PUSH_PROMISE frame's decoded fields.
+func NewH2HeaderRewriter(rewrite func(dir Direction, streamID uint32, fields []hpack.HeaderField) []hpack.HeaderField) *H2HeaderRewriter {
+	return &H2HeaderRewriter{Rewrite: rewrite}
+}
+
+func (h *H2HeaderRewriter) OnH2Frame(dir Direction, evt *H2Frame) {
+	if h.Rewrite == nil || evt.Headers == nil {
+		return
+	}
+	evt.Headers = h.Rewrite(dir, evt.StreamID, evt.Headers)
+}
+
+// SetHeader returns a Rewrite func that sets name to value, replacing any
+// existing field with that name (case-insensitively, per HTTP/2 convention)
+// or appending it if absent.
+func SetHeader(name, value string) func(Direction, uint32, []hpack.HeaderField) []hpack.HeaderField {
+	return func(_ Direction, _ uint32, fields []hpack.HeaderField) []hpack.HeaderField {
+		for i, f := range fields {
+			if strings.EqualFold(f.Name, name) {
+				fields[i].Value = value
+				return fields
+			}
+		}
+		return append(fields, hpack.HeaderField{Name: name, Value: value})
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+// PatchInterceptor overwrites a fixed byte range of each chunk it sees
+// with a literal replacement. Unlike RegexInterceptor it doesn't search for
+// a pattern, which makes it suitable for protocols with fixed-offset binary
+// fields (length-prefixed headers, magic numbers, version bytes) where a
+// regex match could spuriously fire on payload bytes.
+type PatchInterceptor struct {
+	BaseInterceptor
+
+	Offset int
+	Patch  []byte
+
+	Client bool
+	Server bool
+}
+
+// NewPatchInterceptor returns an interceptor that overwrites len(patch)
+// bytes starting at offset on the selected direction(s). A chunk too short
+// to hold the whole range (or a negative offset) passes through unchanged.
+func NewPatchInterceptor(offset int, patch []byte, client, server bool) *PatchInterceptor {
+	return &PatchInterceptor{Offset: offset, Patch: patch, Client: client, Server: server}
+}
+
+func (p *PatchInterceptor) apply(b []byte) []byte {
+	if p.Offset < 0 || p.Offset+len(p.Patch) > len(b) {
+		return b
+	}
+	copy(b[p.Offset:], p.Patch)
+	return b
+}
+
+func (p *PatchInterceptor) OnClientBytes(b []byte) []byte {
+	if !p.Client {
+		return b
+	}
+	return p.apply(b)
+}
+
+func (p *PatchInterceptor) OnServerBytes(b []byte) []byte {
+	if !p.Server {
+		return b
+	}
+	return p.apply(b)
+}
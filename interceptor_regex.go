@@ -0,0 +1,44 @@
+package proxy
+
+import "regexp"
+
+// RegexInterceptor applies a regexp-based find/replace to line-delimited
+// traffic (e.g. text protocols like HTTP/1.1, SMTP, IRC). It operates on
+// whatever chunk boundaries the underlying TCP reads happen to produce, so
+// a pattern that spans a chunk split will not match; it is meant for
+// protocols where matches are expected to land within a single read.
+type RegexInterceptor struct {
+	BaseInterceptor
+
+	Pattern     *regexp.Regexp
+	Replacement []byte
+
+	// Client and Server control which leg of the connection this
+	// interceptor applies to. Leave both false to apply to neither (a no-op).
+	Client bool
+	Server bool
+}
+
+// NewRegexInterceptor compiles pattern and returns an interceptor that
+// replaces every match with replacement on the selected direction(s).
+func NewRegexInterceptor(pattern string, replacement []byte, client, server bool) (*RegexInterceptor, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexInterceptor{Pattern: re, Replacement: replacement, Client: client, Server: server}, nil
+}
+
+func (r *RegexInterceptor) OnClientBytes(b []byte) []byte {
+	if !r.Client {
+		return b
+	}
+	return r.Pattern.ReplaceAll(b, r.Replacement)
+}
+
+func (r *RegexInterceptor) OnServerBytes(b []byte) []byte {
+	if !r.Server {
+		return b
+	}
+	return r.Pattern.ReplaceAll(b, r.Replacement)
+}
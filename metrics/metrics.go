@@ -0,0 +1,104 @@
+// Package metrics exposes Prometheus counters/histograms for a running
+// proxy, plus the glue to serve them over HTTP alongside net/http/pprof.
+// cmd/tcp-proxy's "-metrics-addr" flag gates ListenAndServe behind opt-in,
+// as the reference caller.
+package metrics
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Sink is the set of metrics a Proxy reports to. Construct one with New and
+// pass it into proxy.New; tests can pass a Sink built with a throwaway
+// registry to avoid polluting the default global registry and still be able
+// to read back what it registered.
+type Sink struct {
+	BytesSent            prometheus.Counter
+	BytesReceived        prometheus.Counter
+	ActiveConnections    prometheus.Gauge
+	ConnectionDuration   prometheus.Histogram
+	DialFailures         prometheus.Counter
+	TLSHandshakeFailures prometheus.Counter
+	H2FramesTotal        *prometheus.CounterVec
+	H2StreamDuration     prometheus.Histogram
+
+	registry *prometheus.Registry
+}
+
+// New builds a Sink and registers every metric with reg. Passing a nil reg
+// is valid: New allocates its own private *prometheus.Registry instead of
+// falling back to the global default, so Handler always serves exactly the
+// metrics this Sink owns, whether reg was supplied or not.
+func New(reg *prometheus.Registry) *Sink {
+	if reg == nil {
+		reg = prometheus.NewRegistry()
+	}
+	s := &Sink{
+		BytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tcpproxy_bytes_sent_total",
+			Help: "Bytes forwarded from client to server.",
+		}),
+		BytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tcpproxy_bytes_received_total",
+			Help: "Bytes forwarded from server to client.",
+		}),
+		ActiveConnections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tcpproxy_active_connections",
+			Help: "Proxied connections currently open.",
+		}),
+		ConnectionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tcpproxy_connection_duration_seconds",
+			Help:    "How long a proxied connection stayed open.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		DialFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tcpproxy_dial_failures_total",
+			Help: "Upstream Dialer.Dial calls that returned an error.",
+		}),
+		TLSHandshakeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tcpproxy_tls_handshake_failures_total",
+			Help: "Upstream TLS dials that failed during the handshake.",
+		}),
+		H2FramesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tcpproxy_h2_frames_total",
+			Help: "HTTP/2 frames seen, by frame type.",
+		}, []string{"type"}),
+		H2StreamDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "tcpproxy_h2_stream_duration_seconds",
+			Help:    "Lifetime of an HTTP/2 stream from HEADERS to close.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+
+	reg.MustRegister(
+		s.BytesSent, s.BytesReceived, s.ActiveConnections, s.ConnectionDuration,
+		s.DialFailures, s.TLSHandshakeFailures, s.H2FramesTotal, s.H2StreamDuration,
+	)
+	s.registry = reg
+	return s
+}
+
+// Handler serves /metrics from s's own registry (the one New registered
+// into, whether or not a reg was supplied) and net/http/pprof's profiles
+// under /debug/pprof/, so ListenAndServe(addr, s) is a drop-in opt-in
+// observability endpoint for a running proxy.
+func Handler(s *Sink) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// ListenAndServe starts an HTTP server on addr serving Handler(s). It's
+// meant to be run in its own goroutine, opt-in behind a flag.
+func ListenAndServe(addr string, s *Sink) error {
+	return http.ListenAndServe(addr, Handler(s))
+}
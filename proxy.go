@@ -1,17 +1,13 @@
 package proxy
 
 import (
-	"bytes"
-	"crypto/tls"
-	"encoding/hex"
-	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"time"
 
-	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
+	"github.com/telnet2/go-tcp-proxy/metrics"
 )
 
 // Proxy - Manages a Proxy connection, piping data between local and remote.
@@ -22,12 +18,11 @@ type Proxy struct {
 	lconn, rconn  io.ReadWriteCloser
 	erred         bool
 	errsig        chan bool
-	tlsUnwrapp    bool
-	tlsAddress    string
-	ibf, obf      *os.File
+	h2            *H2Inspector
+	recSession    *Session
+	metrics       *metrics.Sink
 
-	Matcher  func([]byte)
-	Replacer func([]byte) []byte
+	Interceptors *InterceptorChain
 
 	// Settings
 	Nagles         bool
@@ -35,18 +30,45 @@ type Proxy struct {
 	OutputHex      bool
 	OutputRawBytes bool
 	H2             bool
+
+	// Dialer opens the remote connection; defaults to a DirectDialer at
+	// raddr if left nil.
+	Dialer Dialer
+
+	// Recorder, if set, captures this connection's traffic as a pcapng
+	// session instead of the old raw ibf/obf byte dumps.
+	Recorder *Recorder
+
+	// Bandwidth shaping and latency injection; any of these left nil
+	// imposes no limit/delay. UploadLimit/DownloadLimit cap this
+	// connection's own client->server/server->client throughput.
+	// PerIPLimit additionally caps each distinct client IP, and
+	// GlobalLimit is meant to be shared (the same pointer) across every
+	// live Proxy to cap aggregate throughput.
+	UploadLimit   *TokenBucket
+	DownloadLimit *TokenBucket
+	PerIPLimit    *PerIPLimiter
+	GlobalLimit   *TokenBucket
+	Latency       *LatencyInjector
 }
 
 // New - Create a new Proxy instance. Takes over local connection passed in,
-// and closes it when finished.
-func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
+// and closes it when finished. sink is optional: pass a metrics.Sink to
+// have the Proxy report to it (tests can inject one backed by a throwaway
+// registry), or omit it to report to a Sink that isn't wired to anything.
+func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr, sink ...*metrics.Sink) *Proxy {
+	m := metrics.New(nil)
+	if len(sink) > 0 && sink[0] != nil {
+		m = sink[0]
+	}
 	return &Proxy{
-		lconn:  lconn,
-		laddr:  laddr,
-		raddr:  raddr,
-		erred:  false,
-		errsig: make(chan bool),
-		Log:    NullLogger{},
+		lconn:   lconn,
+		laddr:   laddr,
+		raddr:   raddr,
+		erred:   false,
+		errsig:  make(chan bool),
+		Log:     NullLogger{},
+		metrics: m,
 	}
 }
 
@@ -55,8 +77,7 @@ func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
 // locally
 func NewTLSUnwrapped(lconn *net.TCPConn, laddr, raddr *net.TCPAddr, addr string) *Proxy {
 	p := New(lconn, laddr, raddr)
-	p.tlsUnwrapp = true
-	p.tlsAddress = addr
+	p.Dialer = &TLSDialer{Addr: addr}
 	return p
 }
 
@@ -64,26 +85,60 @@ type setNoDelayer interface {
 	SetNoDelay(bool) error
 }
 
-func (p *Proxy) SetInboundFile(f *os.File) {
-	p.ibf = f
-}
-
-func (p *Proxy) SetOutboundFile(f *os.File) {
-	p.obf = f
+// clientAddr returns the connecting client's real remote address, not
+// p.laddr (the proxy's own fixed listen address, the same for every
+// connection). Falls back to p.laddr if lconn doesn't expose one.
+func (p *Proxy) clientAddr() *net.TCPAddr {
+	if conn, ok := p.lconn.(net.Conn); ok {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			return addr
+		}
+	}
+	return p.laddr
 }
 
 // Start - open connection to remote and start proxying data.
 func (p *Proxy) Start() {
 	defer p.lconn.Close()
 
+	started := time.Now()
+	p.metrics.ActiveConnections.Inc()
+	defer func() {
+		p.metrics.ActiveConnections.Dec()
+		p.metrics.ConnectionDuration.Observe(time.Since(started).Seconds())
+	}()
+
+	if p.Dialer == nil {
+		p.Dialer = &DirectDialer{Addr: p.raddr}
+	}
+
+	if p.Recorder != nil {
+		sess, err := p.Recorder.NewSession(p.clientAddr(), p.raddr)
+		if err != nil {
+			p.Log.Warn("Recorder session failed: %s", err)
+		} else {
+			p.recSession = sess
+			// so the capture can be decrypted in Wireshark, have an
+			// unwrapped-TLS upstream log its master secrets into the
+			// session's pcapng Decryption Secrets Block.
+			if tlsd, ok := p.Dialer.(*TLSDialer); ok && tlsd.KeyLogWriter == nil {
+				tlsd.KeyLogWriter = &keyLogRecorder{session: sess}
+			}
+		}
+	}
+
 	var err error
 	//connect to remote
-	if p.tlsUnwrapp {
-		p.rconn, err = tls.Dial("tcp", p.tlsAddress, nil)
-	} else {
-		p.rconn, err = net.DialTCP("tcp", nil, p.raddr)
-	}
+	p.rconn, err = p.Dialer.Dial()
 	if err != nil {
+		p.metrics.DialFailures.Inc()
+		if _, isTLS := p.Dialer.(*TLSDialer); isTLS {
+			// tls.Dial returns a *net.OpError with Op "dial" when the TCP
+			// connection itself fails, before any handshake is attempted.
+			if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "dial" {
+				p.metrics.TLSHandshakeFailures.Inc()
+			}
+		}
 		p.Log.Warn("Remote connection failed: %s", err)
 		return
 	}
@@ -102,12 +157,19 @@ func (p *Proxy) Start() {
 	//display both ends
 	p.Log.Info("Opened %s >>> %s", p.laddr.String(), p.raddr.String())
 
+	if p.H2 {
+		p.h2 = NewH2Inspector(p.Log, p.Interceptors, p.metrics)
+	}
+
 	//bidirectional copy
-	go p.pipe(p.lconn, p.rconn, p.ibf)
-	go p.pipe(p.rconn, p.lconn, p.obf)
+	go p.pipe(p.lconn, p.rconn)
+	go p.pipe(p.rconn, p.lconn)
 
 	//wait for close...
 	<-p.errsig
+	if p.Interceptors != nil {
+		p.Interceptors.OnClose()
+	}
 	p.Log.Info("Closed (%d bytes sent, %d bytes recieved)", p.sentBytes, p.receivedBytes)
 }
 
@@ -122,9 +184,29 @@ func (p *Proxy) err(s string, err error) {
 	p.erred = true
 }
 
-func (p *Proxy) pipe(src, dst io.ReadWriter, f *os.File) {
+func (p *Proxy) pipe(src, dst io.ReadWriter) {
 	islocal := src == p.lconn
 
+	dir := ServerToClient
+	if islocal {
+		dir = ClientToServer
+	}
+	if p.recSession != nil {
+		dst = &recordingWriter{ReadWriter: dst, session: p.recSession, dir: dir}
+	}
+
+	if p.UploadLimit != nil || p.DownloadLimit != nil || p.PerIPLimit != nil || p.GlobalLimit != nil || p.Latency != nil {
+		perDirection := p.DownloadLimit
+		if islocal {
+			perDirection = p.UploadLimit
+		}
+		var perIP *TokenBucket
+		if p.PerIPLimit != nil {
+			perIP = p.PerIPLimit.For(p.clientAddr().IP.String())
+		}
+		dst = &shapingWriter{dst: dst, direction: perDirection, perIP: perIP, global: p.GlobalLimit, latency: p.Latency}
+	}
+
 	var dataDirection string
 	if islocal {
 		dataDirection = ">>> %d bytes sent%s"
@@ -142,60 +224,29 @@ func (p *Proxy) pipe(src, dst io.ReadWriter, f *os.File) {
 	}
 
 	if p.H2 {
-		dir := "<<"
-		if islocal {
-			dir = ">>"
-		}
-
-		w := io.MultiWriter(&bytesWriter{w: os.Stdout, prefix: dir}, dst)
-		tr := io.TeeReader(src, w)
+		tr := io.TeeReader(src, &bytesWriter{w: os.Stdout, prefix: dir.String()})
 
 		if islocal {
-			preface := make([]byte, 24)
-			n, err := tr.Read(preface)
-			if err != nil || n < len(preface) {
-				p.err("Read failed for preface: %v", err)
-				return
-			}
-			http2preface, _ := hex.DecodeString("505249202a20485454502f322e300d0a0d0a534d0d0a0d0a")
-			if !bytes.Equal(preface, http2preface) {
-				p.err("not an HTTP/2 preface: %v", errors.New(string(preface)))
+			if err := p.h2.CheckPreface(tr); err != nil {
+				p.err("%s", err)
 				return
 			}
 		}
 
-		fr := http2.NewFramer(nil, tr)
-		for {
-			f, err := fr.ReadFrame()
-			if err != nil {
-				fmt.Printf("%s read frame error: %v\n", dir, err)
-				return
-			}
+		var cw *countingWriter
+		if islocal {
+			cw = &countingWriter{Writer: dst, total: &p.sentBytes, counter: p.metrics.BytesSent}
+		} else {
+			cw = &countingWriter{Writer: dst, total: &p.receivedBytes, counter: p.metrics.BytesReceived}
+		}
 
-			switch hf := f.(type) {
-			case *http2.SettingsFrame:
-				fmt.Println(dir, "Settings frame:", hf.String())
-				for i := 0; i < hf.NumSettings(); i++ {
-					fmt.Println(hf.Setting(i).String())
-				}
-			case *http2.HeadersFrame:
-				fmt.Println(dir, "Headers frame:", hf.String())
-				decoder := hpack.NewDecoder(2048, nil)
-				fields, _ := decoder.DecodeFull(hf.HeaderBlockFragment())
-				for _, f := range fields {
-					fmt.Println(f.String())
-				}
-			case *http2.DataFrame:
-				fmt.Println(dir, "Data frame:", hf.String(), hf.Data())
-			case *http2.PingFrame:
-				fmt.Println(dir, "Ping frame:", hf.String())
-			case *http2.WindowUpdateFrame:
-				fmt.Println(dir, "Window-update frame:", hf.String())
-			}
+		if err := p.h2.Run(dir, tr, cw); err != nil {
+			p.err("H2 read failed '%s'\n", err)
+			return
 		}
 	} else {
 		//directional copy (64k buffer)
-		tr := io.TeeReader(src, io.MultiWriter(&bytesWriter{w: os.Stdout}, dst))
+		tr := io.TeeReader(src, &bytesWriter{w: os.Stdout})
 		buff := make([]byte, 0xffff)
 		for {
 			n, err := tr.Read(buff)
@@ -205,14 +256,13 @@ func (p *Proxy) pipe(src, dst io.ReadWriter, f *os.File) {
 			}
 			b := buff[:n]
 
-			//execute match
-			if p.Matcher != nil {
-				p.Matcher(b)
-			}
-
-			//execute replace
-			if p.Replacer != nil {
-				b = p.Replacer(b)
+			//run through the interceptor chain
+			if p.Interceptors != nil {
+				if islocal {
+					b = p.Interceptors.OnClientBytes(b)
+				} else {
+					b = p.Interceptors.OnServerBytes(b)
+				}
 			}
 
 			//show output
@@ -224,24 +274,48 @@ func (p *Proxy) pipe(src, dst io.ReadWriter, f *os.File) {
 			}
 
 			//write out result
-			// n, err = dst.Write(b)
-			// if err != nil {
-			// 	p.err("Write failed '%s'\n", err)
-			// 	return
-			// }
-
-			// if f != nil {
-			// 	_, _ = f.Write(b)
-			// }
+			n, err = dst.Write(b)
+			if err != nil {
+				p.err("Write failed '%s'\n", err)
+				return
+			}
+
 			if islocal {
 				p.sentBytes += uint64(n)
+				p.metrics.BytesSent.Add(float64(n))
 			} else {
 				p.receivedBytes += uint64(n)
+				p.metrics.BytesReceived.Add(float64(n))
 			}
 		}
 	}
 }
 
+// counterAdder is the subset of prometheus.Counter that countingWriter
+// needs, so this file doesn't have to import the prometheus package just to
+// name the field type.
+type counterAdder interface {
+	Add(float64)
+}
+
+// countingWriter tallies bytes written to Writer into both the legacy
+// sentBytes/receivedBytes counters (for the "Closed (%d bytes sent, ...)"
+// log line) and the matching metrics.Sink counter, the same bookkeeping the
+// non-H2 path in pipe does inline, since H2Inspector.Run writes frames
+// straight to dst with no equivalent hook.
+type countingWriter struct {
+	io.Writer
+	total   *uint64
+	counter counterAdder
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	*w.total += uint64(n)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
 var _ io.Writer = &bytesWriter{}
 
 type bytesWriter struct {
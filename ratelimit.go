@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a simple token-bucket rate limiter: tokens accrue at
+// RatePerSec up to Burst capacity, and WaitN blocks until n are available.
+// A nil *TokenBucket is treated as unlimited by every caller in this
+// package, so leaving a Proxy's limiter fields unset costs nothing.
+// cmd/tcp-proxy's "-upload-limit"/"-download-limit"/"-per-ip-limit"/
+// "-global-limit" flags are the reference caller.
+type TokenBucket struct {
+	mu         sync.Mutex
+	ratePerSec float64
+	burst      float64
+	tokens     float64
+	last       time.Time
+}
+
+// NewTokenBucket returns a limiter allowing bytesPerSecond sustained
+// throughput with bursts up to burst bytes. If burst is 0 it defaults to
+// bytesPerSecond (one second's worth of tokens).
+func NewTokenBucket(bytesPerSecond, burst int) *TokenBucket {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &TokenBucket{
+		ratePerSec: float64(bytesPerSecond),
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		last:       time.Now(),
+	}
+}
+
+// WaitN blocks until n tokens are available and consumes them.
+func (b *TokenBucket) WaitN(n int) {
+	if b == nil || b.ratePerSec <= 0 {
+		return
+	}
+
+	// The bucket never holds more than burst tokens, so a larger request is
+	// taken in burst-sized pieces.
+	for burst := int(b.burst); burst > 0 && n > burst; n -= burst {
+		b.WaitN(burst)
+	}
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.ratePerSec
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return
+		}
+
+		need := float64(n) - b.tokens
+		wait := time.Duration(need / b.ratePerSec * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// PerIPLimiter hands out one TokenBucket per source IP, all shaped to the
+// same rate/burst, created lazily on first use.
+type PerIPLimiter struct {
+	bytesPerSecond int
+	burst          int
+
+	mu      sync.Mutex
+	buckets map[string]*TokenBucket
+}
+
+// NewPerIPLimiter returns a limiter that caps each distinct source IP at
+// bytesPerSecond.
+func NewPerIPLimiter(bytesPerSecond, burst int) *PerIPLimiter {
+	return &PerIPLimiter{bytesPerSecond: bytesPerSecond, burst: burst, buckets: make(map[string]*TokenBucket)}
+}
+
+// For returns the TokenBucket for ip, creating it on first use.
+func (l *PerIPLimiter) For(ip string) *TokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = NewTokenBucket(l.bytesPerSecond, l.burst)
+		l.buckets[ip] = b
+	}
+	return b
+}
+
+// LatencyInjector adds artificial delay to simulate WAN conditions: a fixed
+// base delay plus up to Jitter of uniformly distributed random extra delay.
+type LatencyInjector struct {
+	Fixed  time.Duration
+	Jitter time.Duration
+}
+
+// Delay returns how long to sleep before the next write, and a nil
+// *LatencyInjector adds no delay.
+func (l *LatencyInjector) Delay() time.Duration {
+	if l == nil {
+		return 0
+	}
+	d := l.Fixed
+	if l.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(l.Jitter)))
+	}
+	return d
+}
+
+// shapingWriter applies a Proxy's configured rate limits and latency
+// injection to every Write before passing it on, so shaping lives between
+// the TeeReader doing the logging/interception and the actual network
+// write, matching where the interceptor chain and the Recorder hook in.
+type shapingWriter struct {
+	dst       io.ReadWriter
+	direction *TokenBucket // UploadLimit or DownloadLimit, by direction
+	perIP     *TokenBucket // from PerIPLimit, by source IP
+	global    *TokenBucket // shared across every Proxy using it
+	latency   *LatencyInjector
+}
+
+func (w *shapingWriter) Write(b []byte) (int, error) {
+	w.direction.WaitN(len(b))
+	w.perIP.WaitN(len(b))
+	w.global.WaitN(len(b))
+	if d := w.latency.Delay(); d > 0 {
+		time.Sleep(d)
+	}
+	return w.dst.Write(b)
+}
+
+func (w *shapingWriter) Read(b []byte) (int, error) {
+	return w.dst.Read(b)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWaitNBlocksPastBurst(t *testing.T) {
+	b := NewTokenBucket(1000, 100) // 1000 B/s, 100 B burst
+
+	start := time.Now()
+	b.WaitN(100) // within burst: should not block
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("WaitN(100) within burst took %s, want near-instant", elapsed)
+	}
+
+	start = time.Now()
+	b.WaitN(50) // burst exhausted: must wait ~50ms for 50 tokens at 1000 B/s
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("WaitN(50) past burst took %s, want >= ~50ms", elapsed)
+	}
+}
+
+func TestTokenBucketNilIsUnlimited(t *testing.T) {
+	var b *TokenBucket
+	start := time.Now()
+	b.WaitN(1 << 30) // a nil *TokenBucket must never block, regardless of n
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("nil TokenBucket.WaitN blocked for %s, want no-op", elapsed)
+	}
+}
+
+func TestPerIPLimiterIsPerIP(t *testing.T) {
+	l := NewPerIPLimiter(1000, 1000)
+
+	a1 := l.For("1.1.1.1")
+	a2 := l.For("1.1.1.1")
+	if a1 != a2 {
+		t.Fatal("For returned different buckets for the same IP")
+	}
+
+	b1 := l.For("2.2.2.2")
+	if a1 == b1 {
+		t.Fatal("For returned the same bucket for two different IPs")
+	}
+}
+
+func TestShapingWriterWithNoLimitsPassesThrough(t *testing.T) {
+	dst := &recordingReadWriter{}
+	w := &shapingWriter{dst: dst}
+
+	n, err := w.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if n != 5 || string(dst.written) != "hello" {
+		t.Fatalf("Write(%q) = %d bytes written %q, want 5 bytes %q", "hello", n, dst.written, "hello")
+	}
+}
+
+type recordingReadWriter struct {
+	written []byte
+}
+
+func (r *recordingReadWriter) Write(b []byte) (int, error) {
+	r.written = append(r.written, b...)
+	return len(b), nil
+}
+
+func (r *recordingReadWriter) Read(b []byte) (int, error) {
+	return 0, nil
+}
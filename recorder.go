@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// recordingWriter mirrors every Write to a recording Session before passing
+// it on to the wrapped connection, so Proxy.pipe can record traffic without
+// its forwarding path knowing a Recorder is involved.
+type recordingWriter struct {
+	io.ReadWriter
+	session *Session
+	dir     Direction
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.session.Write(w.dir, b)
+	return w.ReadWriter.Write(b)
+}
+
+// pcapng block types and magic numbers, per
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	pcapngBlockSectionHeader = 0x0A0D0D0A
+	pcapngBlockInterfaceDesc = 0x00000001
+	pcapngBlockEnhancedPkt   = 0x00000006
+	pcapngBlockDecryptSecret = 0x0000000A
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngVersionMajor   = 1
+	pcapngVersionMinor   = 0
+
+	linkTypeEthernet = 1
+
+	// secretsTypeTLSKeyLog is Wireshark's registered Decryption Secrets
+	// Block secrets type for an NSS-format TLS key log ("TLSK").
+	secretsTypeTLSKeyLog = 0x544c534b
+)
+
+// Recorder writes a pcapng capture file built from synthetic TCP segments
+// reconstructed from the bytes a Proxy actually forwards, in place of the
+// old SetInboundFile/SetOutboundFile raw byte dumps. Each proxied
+// connection gets its own Section Header Block (so a Recorder shared by
+// many concurrent Proxy instances produces one file with a clearly
+// separated section per session) followed by a single Interface
+// Description Block and then one Enhanced Packet Block per chunk written.
+type Recorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRecorder returns a Recorder that appends pcapng blocks to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// Session is one proxied TCP connection's slice of a Recorder's capture. Its
+// methods hold the Recorder's lock, so both pipe goroutines of a Proxy (and
+// a TLS key log writer) may call it concurrently.
+type Session struct {
+	rec          *Recorder
+	client, serv *net.TCPAddr
+	seq          [2]uint32 // next sequence number to emit, by Direction
+}
+
+// NewSession starts a new section in rec's capture for a connection between
+// client and server, and returns a Session to record its traffic on.
+func (r *Recorder) NewSession(client, server *net.TCPAddr) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := writeSectionHeader(r.w); err != nil {
+		return nil, err
+	}
+	if err := writeInterfaceDescription(r.w); err != nil {
+		return nil, err
+	}
+	return &Session{rec: r, client: client, serv: server}, nil
+}
+
+// Write appends one Enhanced Packet Block carrying data as a single TCP
+// segment travelling in direction dir, with PSH+ACK set and the sequence
+// number advanced by len(data).
+func (s *Session) Write(dir Direction, data []byte) error {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	srcIP, dstIP := s.client.IP, s.serv.IP
+	srcPort, dstPort := uint16(s.client.Port), uint16(s.serv.Port)
+	if dir == ServerToClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	frame := buildEthernetIPv4TCP(srcIP, dstIP, srcPort, dstPort, s.seq[dir], data)
+	s.seq[dir] += uint32(len(data))
+
+	return writeEnhancedPacket(s.rec.w, frame, time.Now())
+}
+
+// WriteTLSKeyLog appends keyLogLine (one NSS key log format line, as
+// produced by a tls.Config.KeyLogWriter) to this session's section as a
+// Decryption Secrets Block, so Wireshark can decrypt any TLS it finds in
+// the capture.
+func (s *Session) WriteTLSKeyLog(keyLogLine []byte) error {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+
+	body := make([]byte, 8+len(keyLogLine)+pad4(len(keyLogLine)))
+	binary.LittleEndian.PutUint32(body[0:], secretsTypeTLSKeyLog)
+	binary.LittleEndian.PutUint32(body[4:], uint32(len(keyLogLine)))
+	copy(body[8:], keyLogLine)
+	return writeBlock(s.rec.w, pcapngBlockDecryptSecret, body)
+}
+
+// keyLogRecorder adapts a Session to the io.Writer shape tls.Config.KeyLogWriter
+// expects, so it can be dropped straight into a TLSDialer.
+type keyLogRecorder struct {
+	session *Session
+}
+
+func (k *keyLogRecorder) Write(b []byte) (int, error) {
+	if err := k.session.WriteTLSKeyLog(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func writeSectionHeader(w io.Writer) error {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], pcapngVersionMajor)
+	binary.LittleEndian.PutUint16(body[6:], pcapngVersionMinor)
+	binary.LittleEndian.PutUint64(body[8:], 0xFFFFFFFFFFFFFFFF) // section length unknown
+	return writeBlock(w, pcapngBlockSectionHeader, body)
+}
+
+func writeInterfaceDescription(w io.Writer) error {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], linkTypeEthernet)
+	binary.LittleEndian.PutUint16(body[2:], 0) // reserved
+	binary.LittleEndian.PutUint32(body[4:], 65535)
+	return writeBlock(w, pcapngBlockInterfaceDesc, body)
+}
+
+func writeEnhancedPacket(w io.Writer, packet []byte, ts time.Time) error {
+	usec := uint64(ts.UnixNano() / int64(time.Microsecond))
+
+	body := make([]byte, 20+len(packet)+pad4(len(packet)))
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id (this section's only interface)
+	binary.LittleEndian.PutUint32(body[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	copy(body[20:], packet)
+	return writeBlock(w, pcapngBlockEnhancedPkt, body)
+}
+
+// writeBlock wraps body with the generic pcapng block framing: type, total
+// length, body (already padded to a 4-byte boundary by the caller where
+// relevant), and a trailing copy of total length.
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	total := 12 + len(body)
+	buf := make([]byte, total)
+	binary.LittleEndian.PutUint32(buf[0:], blockType)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(total))
+	copy(buf[8:], body)
+	binary.LittleEndian.PutUint32(buf[total-4:], uint32(total))
+	_, err := w.Write(buf)
+	return err
+}
+
+func pad4(n int) int {
+	if r := n % 4; r != 0 {
+		return 4 - r
+	}
+	return 0
+}
+
+const ethHeaderLen = 14
+const ipHeaderLen = 20
+const tcpHeaderLen = 20
+
+// buildEthernetIPv4TCP wraps data in a minimal Ethernet/IPv4/TCP frame so
+// Wireshark can dissect the capture (and any higher-level protocol, e.g.
+// HTTP/2, layered on top of the TCP payload) instead of seeing an opaque
+// byte dump.
+func buildEthernetIPv4TCP(srcIP, dstIP net.IP, srcPort, dstPort uint16, seq uint32, data []byte) []byte {
+	srcIP4, dstIP4 := srcIP.To4(), dstIP.To4()
+	if srcIP4 == nil {
+		srcIP4 = net.IPv4(127, 0, 0, 1).To4()
+	}
+	if dstIP4 == nil {
+		dstIP4 = net.IPv4(127, 0, 0, 1).To4()
+	}
+
+	frame := make([]byte, ethHeaderLen+ipHeaderLen+tcpHeaderLen+len(data))
+
+	// Ethernet: locally-administered placeholder MACs, EtherType IPv4.
+	copy(frame[0:6], []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02})
+	copy(frame[6:12], []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01})
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+
+	ip := frame[ethHeaderLen : ethHeaderLen+ipHeaderLen]
+	totalLen := ipHeaderLen + tcpHeaderLen + len(data)
+	ip[0] = 0x45 // version 4, IHL 5
+	ip[1] = 0x00
+	binary.BigEndian.PutUint16(ip[2:4], uint16(totalLen))
+	binary.BigEndian.PutUint16(ip[4:6], 0) // identification
+	binary.BigEndian.PutUint16(ip[6:8], 0) // flags/fragment offset
+	ip[8] = 64                             // TTL
+	ip[9] = 6                              // protocol: TCP
+	binary.BigEndian.PutUint16(ip[10:12], 0)
+	copy(ip[12:16], srcIP4)
+	copy(ip[16:20], dstIP4)
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	tcp := frame[ethHeaderLen+ipHeaderLen : ethHeaderLen+ipHeaderLen+tcpHeaderLen]
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], 0) // ack number: unmodeled, this is a one-way synthetic stream
+	tcp[12] = tcpHeaderLen / 4 << 4          // data offset
+	tcp[13] = 0x18                           // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	binary.BigEndian.PutUint16(tcp[16:18], 0) // checksum, filled below
+	binary.BigEndian.PutUint16(tcp[18:20], 0) // urgent pointer
+
+	copy(frame[ethHeaderLen+ipHeaderLen+tcpHeaderLen:], data)
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(srcIP4, dstIP4, tcp, data))
+
+	return frame
+}
+
+func ipChecksum(header []byte) uint16 {
+	return checksum(header)
+}
+
+func tcpChecksum(srcIP, dstIP net.IP, tcpHeader, payload []byte) uint16 {
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], srcIP)
+	copy(pseudo[4:8], dstIP)
+	pseudo[8] = 0
+	pseudo[9] = 6 // TCP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcpHeader)+len(payload)))
+
+	sum := checksumAccumulate(0, pseudo)
+	sum = checksumAccumulate(sum, tcpHeader)
+	sum = checksumAccumulate(sum, payload)
+	return finishChecksum(sum)
+}
+
+func checksum(b []byte) uint16 {
+	return finishChecksum(checksumAccumulate(0, b))
+}
+
+func checksumAccumulate(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func finishChecksum(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}